@@ -0,0 +1,112 @@
+package drafty
+
+// Preview is a structured summary of a Drafty document suitable for a push notification: enough
+// to render "📷 Photo" / "📎 filename.pdf" / "@you was mentioned" style previews without the
+// client having to re-parse the full Drafty tree.
+type Preview struct {
+	// PreviewText is the plain-text fallback as returned by ToPlainText; it is not truncated here.
+	PreviewText string
+	// HasImage/HasVideo/HasFile report the kind of the first attachment found, if any.
+	HasImage bool
+	HasVideo bool
+	HasFile  bool
+	// Mime and Name describe the first attachment, if any.
+	Mime string
+	Name string
+	// Mentions lists the UIDs of all @mentioned users.
+	Mentions []string
+	// IsReply is true when the message quotes another message.
+	IsReply bool
+	// ReplyAuthor is the UID of the quoted message's author, set only when IsReply is true.
+	ReplyAuthor string
+}
+
+// Entity type tags used by the Drafty wire format.
+const (
+	entImage   = "IM"
+	entAttach  = "EX"
+	entMention = "MN"
+	// entQuote is Drafty's reply-quote entity. Note this is distinct from "RW" (row), which
+	// tags form-row entities nested under an "FM" (form) entity.
+	entQuote = "QQ"
+)
+
+// ToNotificationPreview extracts a structured Preview out of a Drafty document. content is the
+// generic JSON-decoded Drafty tree (the same value accepted by ToPlainText). Falls back to a
+// plain-text-only preview when no structural signal (attachment, mention, quote) is present.
+func ToNotificationPreview(content interface{}) (*Preview, error) {
+	text, err := ToPlainText(content)
+	if err != nil {
+		return nil, err
+	}
+
+	pv := &Preview{PreviewText: text}
+
+	doc, ok := content.(map[string]interface{})
+	if !ok {
+		return pv, nil
+	}
+
+	ents, _ := doc["ent"].([]interface{})
+	for _, e := range ents {
+		ent, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tp, _ := ent["tp"].(string)
+		data, _ := ent["data"].(map[string]interface{})
+
+		switch tp {
+		case entImage, entAttach:
+			if pv.HasImage || pv.HasVideo || pv.HasFile {
+				// Only the first attachment drives the preview.
+				continue
+			}
+			mime, _ := data["mime"].(string)
+			name, _ := data["name"].(string)
+			pv.Mime = mime
+			pv.Name = name
+			if tp == entImage {
+				pv.HasImage = true
+			} else if isVideoMime(mime) {
+				pv.HasVideo = true
+			} else {
+				pv.HasFile = true
+			}
+		case entMention:
+			if uid, ok := data["val"].(string); ok && uid != "" {
+				pv.Mentions = append(pv.Mentions, uid)
+			}
+		case entQuote:
+			pv.IsReply = true
+			if author, ok := data["author"].(string); ok {
+				pv.ReplyAuthor = author
+			}
+		}
+	}
+
+	return pv, nil
+}
+
+func isVideoMime(mime string) bool {
+	return len(mime) > 6 && mime[:6] == "video/"
+}
+
+// BodyLocKey picks the localization key the client should use to render the notification body,
+// preferring structural signals over the plain-text fallback.
+func (pv *Preview) BodyLocKey() string {
+	switch {
+	case pv.IsReply:
+		return "notif_reply"
+	case len(pv.Mentions) > 0:
+		return "notif_mention"
+	case pv.HasImage:
+		return "notif_image_from"
+	case pv.HasVideo:
+		return "notif_video_from"
+	case pv.HasFile:
+		return "notif_file_from"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,163 @@
+package drafty
+
+import "testing"
+
+func TestToNotificationPreview(t *testing.T) {
+	tests := []struct {
+		name    string
+		content interface{}
+		want    Preview
+	}{
+		{
+			name:    "plain text only",
+			content: "hello world",
+			want:    Preview{PreviewText: "hello world"},
+		},
+		{
+			name: "image attachment",
+			content: map[string]interface{}{
+				"txt": "photo",
+				"ent": []interface{}{
+					map[string]interface{}{
+						"tp": "IM",
+						"data": map[string]interface{}{
+							"mime": "image/jpeg",
+							"name": "cat.jpg",
+						},
+					},
+				},
+			},
+			want: Preview{PreviewText: "photo", HasImage: true, Mime: "image/jpeg", Name: "cat.jpg"},
+		},
+		{
+			name: "video attachment classified via mime",
+			content: map[string]interface{}{
+				"txt": "clip",
+				"ent": []interface{}{
+					map[string]interface{}{
+						"tp": "EX",
+						"data": map[string]interface{}{
+							"mime": "video/mp4",
+							"name": "clip.mp4",
+						},
+					},
+				},
+			},
+			want: Preview{PreviewText: "clip", HasVideo: true, Mime: "video/mp4", Name: "clip.mp4"},
+		},
+		{
+			name: "file attachment",
+			content: map[string]interface{}{
+				"txt": "doc",
+				"ent": []interface{}{
+					map[string]interface{}{
+						"tp": "EX",
+						"data": map[string]interface{}{
+							"mime": "application/pdf",
+							"name": "report.pdf",
+						},
+					},
+				},
+			},
+			want: Preview{PreviewText: "doc", HasFile: true, Mime: "application/pdf", Name: "report.pdf"},
+		},
+		{
+			name: "only first attachment drives the preview",
+			content: map[string]interface{}{
+				"txt": "two files",
+				"ent": []interface{}{
+					map[string]interface{}{
+						"tp":   "IM",
+						"data": map[string]interface{}{"mime": "image/png", "name": "a.png"},
+					},
+					map[string]interface{}{
+						"tp":   "EX",
+						"data": map[string]interface{}{"mime": "application/pdf", "name": "b.pdf"},
+					},
+				},
+			},
+			want: Preview{PreviewText: "two files", HasImage: true, Mime: "image/png", Name: "a.png"},
+		},
+		{
+			name: "mentions collected in order",
+			content: map[string]interface{}{
+				"txt": "hi @alice @bob",
+				"ent": []interface{}{
+					map[string]interface{}{"tp": "MN", "data": map[string]interface{}{"val": "usrAlice"}},
+					map[string]interface{}{"tp": "MN", "data": map[string]interface{}{"val": "usrBob"}},
+				},
+			},
+			want: Preview{PreviewText: "hi @alice @bob", Mentions: []string{"usrAlice", "usrBob"}},
+		},
+		{
+			name: "quote marks a reply",
+			content: map[string]interface{}{
+				"txt": "sure thing",
+				"ent": []interface{}{
+					map[string]interface{}{"tp": "QQ", "data": map[string]interface{}{"author": "usrAlice"}},
+				},
+			},
+			want: Preview{PreviewText: "sure thing", IsReply: true, ReplyAuthor: "usrAlice"},
+		},
+		{
+			name: "form row is not mistaken for a reply",
+			content: map[string]interface{}{
+				"txt": "pick one",
+				"ent": []interface{}{
+					map[string]interface{}{"tp": "RW", "data": map[string]interface{}{"author": "usrAlice"}},
+				},
+			},
+			want: Preview{PreviewText: "pick one"},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ToNotificationPreview(tc.content)
+			if err != nil {
+				t.Fatalf("ToNotificationPreview() error = %v", err)
+			}
+			if got.PreviewText != tc.want.PreviewText ||
+				got.HasImage != tc.want.HasImage ||
+				got.HasVideo != tc.want.HasVideo ||
+				got.HasFile != tc.want.HasFile ||
+				got.Mime != tc.want.Mime ||
+				got.Name != tc.want.Name ||
+				got.IsReply != tc.want.IsReply ||
+				got.ReplyAuthor != tc.want.ReplyAuthor ||
+				len(got.Mentions) != len(tc.want.Mentions) {
+				t.Errorf("ToNotificationPreview() = %+v, want %+v", got, tc.want)
+			}
+			for i := range tc.want.Mentions {
+				if i >= len(got.Mentions) || got.Mentions[i] != tc.want.Mentions[i] {
+					t.Errorf("Mentions = %v, want %v", got.Mentions, tc.want.Mentions)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestBodyLocKey(t *testing.T) {
+	tests := []struct {
+		name string
+		pv   Preview
+		want string
+	}{
+		{"reply takes priority", Preview{IsReply: true, HasImage: true}, "notif_reply"},
+		{"mention over image", Preview{Mentions: []string{"usr1"}, HasImage: true}, "notif_mention"},
+		{"image", Preview{HasImage: true}, "notif_image_from"},
+		{"video", Preview{HasVideo: true}, "notif_video_from"},
+		{"file", Preview{HasFile: true}, "notif_file_from"},
+		{"plain text has no loc key", Preview{PreviewText: "hi"}, ""},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.pv.BodyLocKey(); got != tc.want {
+				t.Errorf("BodyLocKey() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+// Package apns implements push notification plugin for Apple's APNs backend.
+// Notifications are delivered directly over the APNs HTTP/2 API, without going through FCM,
+// using either a p8 token-signing key or a p12 certificate for authentication.
+package apns
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	apns2 "github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/certificate"
+	"github.com/sideshow/apns2/payload"
+	"github.com/sideshow/apns2/token"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var handler Handler
+
+// Size of the input channel buffer.
+const defaultBuffer = 32
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input  chan *push.Receipt
+	stop   chan bool
+	client *apns2.Client
+	topic  string
+}
+
+type configType struct {
+	push.ProviderConfig
+	// Bundle ID of the client app; required, used as the APNs topic.
+	Topic string `json:"topic"`
+	// Sandbox selects the APNs development environment instead of production.
+	Sandbox bool `json:"sandbox,omitempty"`
+
+	// Token-based (p8) authentication.
+	KeyID   string `json:"key_id,omitempty"`
+	TeamID  string `json:"team_id,omitempty"`
+	KeyFile string `json:"key_file,omitempty"`
+	Key     string `json:"key,omitempty"`
+
+	// Certificate-based (p12) authentication, used when Key/KeyFile are not set.
+	CertFile     string `json:"cert_file,omitempty"`
+	CertPassword string `json:"cert_password,omitempty"`
+
+	// Priority of notifications sent through this provider: "low", "normal" or "high".
+	// Defaults to "high". Compared against a user's MinPriority push pref.
+	Priority string `json:"priority,omitempty"`
+}
+
+// Init initializes the push handler.
+func (Handler) Init(jsonconf string) error {
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return errors.New("apns: failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return nil
+	}
+	if config.Topic == "" {
+		return errors.New("apns: missing topic")
+	}
+
+	var client *apns2.Client
+	if config.KeyFile != "" || config.Key != "" {
+		var authKey interface{}
+		var err error
+		if config.Key != "" {
+			authKey, err = token.AuthKeyFromBytes([]byte(config.Key))
+		} else {
+			authKey, err = token.AuthKeyFromFile(config.KeyFile)
+		}
+		if err != nil {
+			return errors.New("apns: invalid p8 key: " + err.Error())
+		}
+		tok := &token.Token{
+			AuthKey: authKey,
+			KeyID:   config.KeyID,
+			TeamID:  config.TeamID,
+		}
+		client = apns2.NewTokenClient(tok)
+	} else if config.CertFile != "" {
+		cert, err := certificate.FromP12File(config.CertFile, config.CertPassword)
+		if err != nil {
+			return errors.New("apns: invalid p12 certificate: " + err.Error())
+		}
+		client = apns2.NewClient(cert)
+	} else {
+		return errors.New("apns: missing credentials")
+	}
+
+	if config.Sandbox {
+		client = client.Development()
+	} else {
+		client = client.Production()
+	}
+
+	handler.client = client
+	handler.topic = config.Topic
+
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+	if config.Priority == "" {
+		config.Priority = "high"
+	}
+
+	handler.input = make(chan *push.Receipt, config.Buffer)
+	handler.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendNotifications(rcpt, &config)
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func sendNotifications(rcpt *push.Receipt, config *configType) {
+	uids := make([]t.Uid, len(rcpt.To))
+	skipDevices := make(map[string]bool)
+	i := 0
+	for uid, to := range rcpt.To {
+		uids[i] = uid
+		i++
+		for _, deviceID := range to.Devices {
+			skipDevices[deviceID] = true
+		}
+	}
+
+	devices, count, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		log.Println("apns push: db error", err)
+		return
+	}
+	if count == 0 {
+		return
+	}
+
+	text := ""
+	if rcpt.Payload.What == push.ActMsg {
+		text, _ = drafty.ToPlainText(rcpt.Payload.Content)
+	}
+
+	for uid, devList := range devices {
+		prefs, err := store.Users.GetPushPrefs(uid)
+		if err != nil {
+			log.Println("apns push: failed to get push prefs", uid, err)
+		}
+		if push.IsMuted(prefs, rcpt.Payload.Topic) {
+			// User has muted this topic: no push at all, not even a silent one.
+			continue
+		}
+		if push.BelowThreshold(prefs, config.Priority) {
+			// Below the user's configured priority floor: drop it entirely.
+			continue
+		}
+		// Quiet hours force a silent, badge-only push regardless of rcpt.Payload.Silent.
+		silent := rcpt.Payload.Silent || push.InQuietHours(prefs, time.Now())
+
+		builder := payload.NewPayload().ContentAvailable()
+		if !silent {
+			builder = builder.AlertTitle("New message")
+			if text != "" {
+				builder = builder.AlertBody(text)
+			}
+		}
+
+		for i := range devList {
+			d := &devList[i]
+			if _, ok := skipDevices[d.DeviceId]; ok || d.DeviceId == "" || push.DeviceProvider(d) != "apns" {
+				continue
+			}
+
+			badge := rcpt.To[uid].Unread
+			notification := &apns2.Notification{
+				DeviceToken: d.DeviceId,
+				Topic:       config.Topic,
+				Payload:     builder.Badge(badge),
+			}
+			if config.TimeToLive > 0 {
+				notification.Expiration = time.Now().Add(time.Duration(config.TimeToLive) * time.Second)
+			}
+
+			res, err := handler.client.Push(notification)
+			if err != nil {
+				log.Println("apns push: transient failure", err)
+				continue
+			}
+			if !res.Sent() {
+				if res.Reason == apns2.ReasonBadDeviceToken || res.Reason == apns2.ReasonUnregistered {
+					log.Println("apns push: invalid token", res.Reason)
+					if err := store.Devices.Delete(uid, d.DeviceId); err != nil {
+						log.Println("apns push: failed to delete invalid token", err)
+					}
+				} else {
+					log.Println("apns push:", res.StatusCode, res.Reason)
+				}
+			}
+		}
+	}
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Stop shuts down the handler.
+func (Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register("apns", &handler)
+}
@@ -0,0 +1,47 @@
+package push
+
+import (
+	"time"
+
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// priorityRank orders priority levels for threshold comparisons.
+var priorityRank = map[string]int{"low": 0, "normal": 1, "high": 2}
+
+// InQuietHours reports whether 'now' falls within the user's configured quiet-hours window,
+// interpreted in the timezone the window was set in. A zero-value window (From == To) means
+// quiet hours are disabled. Shared by every push provider so DND behavior is consistent
+// regardless of which backend a device is routed through.
+func InQuietHours(prefs *t.PushPrefs, now time.Time) bool {
+	if prefs == nil || prefs.QuietHours.From == prefs.QuietHours.To {
+		return false
+	}
+
+	loc, err := time.LoadLocation(prefs.QuietHours.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+	minutes := local.Hour()*60 + local.Minute()
+
+	from, to := prefs.QuietHours.From, prefs.QuietHours.To
+	if from <= to {
+		return minutes >= from && minutes < to
+	}
+	// Window wraps past midnight, e.g. 22:00-07:00.
+	return minutes >= from || minutes < to
+}
+
+// IsMuted reports whether the user has muted push notifications for the given topic.
+func IsMuted(prefs *t.PushPrefs, topic string) bool {
+	return prefs != nil && prefs.MutedTopics != nil && prefs.MutedTopics[topic]
+}
+
+// BelowThreshold reports whether 'priority' falls below the user's configured minimum.
+func BelowThreshold(prefs *t.PushPrefs, priority string) bool {
+	if prefs == nil || prefs.MinPriority == "" {
+		return false
+	}
+	return priorityRank[priority] < priorityRank[prefs.MinPriority]
+}
@@ -0,0 +1,108 @@
+package push
+
+import (
+	"testing"
+	"time"
+
+	types "github.com/tinode/chat/server/store/types"
+)
+
+func TestInQuietHours(t *testing.T) {
+	tests := []struct {
+		name  string
+		prefs *types.PushPrefs
+		now   string // RFC3339 in UTC
+		want  bool
+	}{
+		{
+			name:  "nil prefs",
+			prefs: nil,
+			now:   "2026-07-27T23:00:00Z",
+			want:  false,
+		},
+		{
+			name:  "zero-value window disabled",
+			prefs: &types.PushPrefs{QuietHours: types.QuietHours{From: 0, To: 0, Timezone: "UTC"}},
+			now:   "2026-07-27T23:00:00Z",
+			want:  false,
+		},
+		{
+			name:  "same-day window, inside",
+			prefs: &types.PushPrefs{QuietHours: types.QuietHours{From: 13 * 60, To: 14 * 60, Timezone: "UTC"}},
+			now:   "2026-07-27T13:30:00Z",
+			want:  true,
+		},
+		{
+			name:  "same-day window, outside",
+			prefs: &types.PushPrefs{QuietHours: types.QuietHours{From: 13 * 60, To: 14 * 60, Timezone: "UTC"}},
+			now:   "2026-07-27T15:00:00Z",
+			want:  false,
+		},
+		{
+			name:  "midnight wraparound, inside late evening",
+			prefs: &types.PushPrefs{QuietHours: types.QuietHours{From: 22 * 60, To: 7 * 60, Timezone: "UTC"}},
+			now:   "2026-07-27T23:30:00Z",
+			want:  true,
+		},
+		{
+			name:  "midnight wraparound, inside early morning",
+			prefs: &types.PushPrefs{QuietHours: types.QuietHours{From: 22 * 60, To: 7 * 60, Timezone: "UTC"}},
+			now:   "2026-07-27T03:00:00Z",
+			want:  true,
+		},
+		{
+			name:  "midnight wraparound, outside at noon",
+			prefs: &types.PushPrefs{QuietHours: types.QuietHours{From: 22 * 60, To: 7 * 60, Timezone: "UTC"}},
+			now:   "2026-07-27T12:00:00Z",
+			want:  false,
+		},
+		{
+			name:  "invalid timezone falls back to UTC",
+			prefs: &types.PushPrefs{QuietHours: types.QuietHours{From: 13 * 60, To: 14 * 60, Timezone: "Not/AZone"}},
+			now:   "2026-07-27T13:30:00Z",
+			want:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			now, err := time.Parse(time.RFC3339, tc.now)
+			if err != nil {
+				t.Fatalf("bad test fixture: %v", err)
+			}
+			if got := InQuietHours(tc.prefs, now); got != tc.want {
+				t.Errorf("InQuietHours() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsMuted(t *testing.T) {
+	prefs := &types.PushPrefs{MutedTopics: map[string]bool{"usrAbc": true}}
+	if !IsMuted(prefs, "usrAbc") {
+		t.Error("expected topic to be muted")
+	}
+	if IsMuted(prefs, "usrXyz") {
+		t.Error("expected topic to not be muted")
+	}
+	if IsMuted(nil, "usrAbc") {
+		t.Error("nil prefs must never be muted")
+	}
+}
+
+func TestBelowThreshold(t *testing.T) {
+	prefs := &types.PushPrefs{MinPriority: "high"}
+	if !BelowThreshold(prefs, "normal") {
+		t.Error("normal should be below a high threshold")
+	}
+	if BelowThreshold(prefs, "high") {
+		t.Error("high should not be below a high threshold")
+	}
+	if BelowThreshold(nil, "low") {
+		t.Error("nil prefs must never filter anything out")
+	}
+	if BelowThreshold(&types.PushPrefs{}, "low") {
+		t.Error("unset MinPriority must never filter anything out")
+	}
+}
@@ -0,0 +1,23 @@
+package fcm
+
+import (
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// inQuietHours, isMuted and belowThreshold moved to the push package so every provider enforces
+// the same DND rules; these thin wrappers keep the call sites in push_fcm.go unchanged.
+
+func inQuietHours(prefs *t.PushPrefs, now time.Time) bool {
+	return push.InQuietHours(prefs, now)
+}
+
+func isMuted(prefs *t.PushPrefs, topic string) bool {
+	return push.IsMuted(prefs, topic)
+}
+
+func belowThreshold(prefs *t.PushPrefs, priority string) bool {
+	return push.BelowThreshold(prefs, priority)
+}
@@ -1,5 +1,7 @@
 // Package fcm implements push notification plugin for Google FCM backend.
 // Push notifications for Android, iOS and web clients are sent through Google's Firebase Cloud Messaging service.
+// Devices with an explicit t.Device.PushProvider pointing elsewhere (e.g. "apns", "hms", "webpush") are
+// skipped here and handled by the matching sibling package under server/push/.
 package fcm
 
 import (
@@ -8,6 +10,7 @@ import (
 	"errors"
 	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	fbase "firebase.google.com/go"
@@ -35,6 +38,7 @@ type Handler struct {
 	input  chan *push.Receipt
 	stop   chan bool
 	client *fcm.Client
+	queue  *workQueue
 }
 
 // Configuration of AndroidNotification payload.
@@ -44,7 +48,7 @@ type androidConfig struct {
 	androidPayload
 	// Configs for specific push types.
 	Msg androidPayload `json:"msg,omitempty"`
-	Sub androidPayload `json:"msg,omitempty"`
+	Sub androidPayload `json:"sub,omitempty"`
 }
 
 func (ac *androidConfig) getTitleLocKey(what string) string {
@@ -125,24 +129,255 @@ func (ac *androidConfig) getIconColor(what string) string {
 	return color
 }
 
+// Configuration of the APNS portion of the FCM message sent to iOS devices.
+type iosConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Common defaults for all push types.
+	iosPayload
+	// Configs for specific push types.
+	Msg iosPayload `json:"msg,omitempty"`
+	Sub iosPayload `json:"sub,omitempty"`
+}
+
+func (ic *iosConfig) getThreadID(what string) string {
+	var v string
+	if what == push.ActMsg {
+		v = ic.Msg.ThreadID
+	} else if what == push.ActSub {
+		v = ic.Sub.ThreadID
+	}
+	if v == "" {
+		v = ic.iosPayload.ThreadID
+	}
+	return v
+}
+
+func (ic *iosConfig) getCategory(what string) string {
+	var v string
+	if what == push.ActMsg {
+		v = ic.Msg.Category
+	} else if what == push.ActSub {
+		v = ic.Sub.Category
+	}
+	if v == "" {
+		v = ic.iosPayload.Category
+	}
+	return v
+}
+
+func (ic *iosConfig) getInterruptionLevel(what string) string {
+	var v string
+	if what == push.ActMsg {
+		v = ic.Msg.InterruptionLevel
+	} else if what == push.ActSub {
+		v = ic.Sub.InterruptionLevel
+	}
+	if v == "" {
+		v = ic.iosPayload.InterruptionLevel
+	}
+	if v == "" {
+		v = "active"
+	}
+	return v
+}
+
+func (ic *iosConfig) getRelevanceScore(what string) float64 {
+	var v float64
+	if what == push.ActMsg {
+		v = ic.Msg.RelevanceScore
+	} else if what == push.ActSub {
+		v = ic.Sub.RelevanceScore
+	}
+	if v == 0 {
+		v = ic.iosPayload.RelevanceScore
+	}
+	return v
+}
+
+func (ic *iosConfig) getTargetContentID(what string) string {
+	var v string
+	if what == push.ActMsg {
+		v = ic.Msg.TargetContentID
+	} else if what == push.ActSub {
+		v = ic.Sub.TargetContentID
+	}
+	if v == "" {
+		v = ic.iosPayload.TargetContentID
+	}
+	return v
+}
+
+func (ic *iosConfig) getSubtitle(what string) string {
+	var v string
+	if what == push.ActMsg {
+		v = ic.Msg.Subtitle
+	} else if what == push.ActSub {
+		v = ic.Sub.Subtitle
+	}
+	if v == "" {
+		v = ic.iosPayload.Subtitle
+	}
+	return v
+}
+
+func (ic *iosConfig) getTitleLocKey(what string) string {
+	var v string
+	if what == push.ActMsg {
+		v = ic.Msg.TitleLocKey
+	} else if what == push.ActSub {
+		v = ic.Sub.TitleLocKey
+	}
+	if v == "" {
+		v = ic.iosPayload.TitleLocKey
+	}
+	return v
+}
+
+func (ic *iosConfig) getLocKey(what string) string {
+	var v string
+	if what == push.ActMsg {
+		v = ic.Msg.LocKey
+	} else if what == push.ActSub {
+		v = ic.Sub.LocKey
+	}
+	if v == "" {
+		v = ic.iosPayload.LocKey
+	}
+	return v
+}
+
+func (ic *iosConfig) getTitleLocArgs(what string) []string {
+	var v []string
+	if what == push.ActMsg {
+		v = ic.Msg.TitleLocArgs
+	} else if what == push.ActSub {
+		v = ic.Sub.TitleLocArgs
+	}
+	if v == nil {
+		v = ic.iosPayload.TitleLocArgs
+	}
+	return v
+}
+
+func (ic *iosConfig) getLocArgs(what string) []string {
+	var v []string
+	if what == push.ActMsg {
+		v = ic.Msg.LocArgs
+	} else if what == push.ActSub {
+		v = ic.Sub.LocArgs
+	}
+	if v == nil {
+		v = ic.iosPayload.LocArgs
+	}
+	return v
+}
+
+// Payload to be sent for a specific notification type, APNS flavor.
+type iosPayload struct {
+	ThreadID          string      `json:"thread_id,omitempty"`
+	Category          string      `json:"category,omitempty"`
+	InterruptionLevel string      `json:"interruption_level,omitempty"`
+	RelevanceScore    float64     `json:"relevance_score,omitempty"`
+	TargetContentID   string      `json:"target_content_id,omitempty"`
+	Subtitle          string      `json:"subtitle,omitempty"`
+	TitleLocKey       string      `json:"title_loc_key,omitempty"`
+	TitleLocArgs      []string    `json:"title_loc_args,omitempty"`
+	LocKey            string      `json:"loc_key,omitempty"`
+	LocArgs           []string    `json:"loc_args,omitempty"`
+	Options           pushOptions `json:"options,omitempty"`
+}
+
 // Payload to be sent for a specific notification type.
 type androidPayload struct {
-	TitleLocKey string `json:"title_loc_key,omitempty"`
-	Title       string `json:"title,omitempty"`
-	BodyLocKey  string `json:"body_loc_key,omitempty"`
-	Body        string `json:"body,omitempty"`
-	Icon        string `json:"icon,omitempty"`
-	IconColor   string `json:"icon_color,omitempty"`
-	ClickAction string `json:"click_action,omitempty"`
+	TitleLocKey string      `json:"title_loc_key,omitempty"`
+	Title       string      `json:"title,omitempty"`
+	BodyLocKey  string      `json:"body_loc_key,omitempty"`
+	Body        string      `json:"body,omitempty"`
+	Icon        string      `json:"icon,omitempty"`
+	IconColor   string      `json:"icon_color,omitempty"`
+	ClickAction string      `json:"click_action,omitempty"`
+	Options     pushOptions `json:"options,omitempty"`
+}
+
+// pushOptions controls delivery behavior that applies equally to Android and iOS. It can be set
+// globally in configType.Options, and overridden per push-type in androidPayload/iosPayload; a
+// zero-value field in the per-type override falls back to the global setting.
+type pushOptions struct {
+	// Silent suppresses the visible notification entirely: clients get a data-only, content-available
+	// wake-up (used e.g. for typing/read receipts).
+	Silent bool `json:"silent,omitempty"`
+	// CollapseKey groups messages FCM may collapse into the latest one.
+	CollapseKey string `json:"collapse_key,omitempty"`
+	// TimeToLive is how long FCM should keep trying to deliver the message, in seconds.
+	TimeToLive uint `json:"time_to_live,omitempty"`
+	// Priority is either "high" or "normal".
+	Priority              string `json:"priority,omitempty"`
+	DelayWhileIdle        bool   `json:"delay_while_idle,omitempty"`
+	ContentAvailable      bool   `json:"content_available,omitempty"`
+	MutableContent        bool   `json:"mutable_content,omitempty"`
+	RestrictedPackageName string `json:"restricted_package_name,omitempty"`
+	// DryRun asks FCM to validate the message without actually delivering it.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// resolveOptions merges the global default options with the per-push-type override for 'what',
+// with the override's non-zero fields taking precedence.
+func resolveOptions(what string, global, msgOpt, subOpt pushOptions) pushOptions {
+	opt := global
+
+	var override pushOptions
+	if what == push.ActMsg {
+		override = msgOpt
+	} else if what == push.ActSub {
+		override = subOpt
+	}
+
+	if override.Silent {
+		opt.Silent = true
+	}
+	if override.CollapseKey != "" {
+		opt.CollapseKey = override.CollapseKey
+	}
+	if override.TimeToLive != 0 {
+		opt.TimeToLive = override.TimeToLive
+	}
+	if override.Priority != "" {
+		opt.Priority = override.Priority
+	}
+	if override.DelayWhileIdle {
+		opt.DelayWhileIdle = true
+	}
+	if override.ContentAvailable {
+		opt.ContentAvailable = true
+	}
+	if override.MutableContent {
+		opt.MutableContent = true
+	}
+	if override.RestrictedPackageName != "" {
+		opt.RestrictedPackageName = override.RestrictedPackageName
+	}
+	if override.DryRun {
+		opt.DryRun = true
+	}
+
+	if opt.Priority == "" {
+		opt.Priority = "high"
+	}
+	return opt
 }
 
 type configType struct {
-	Enabled         bool            `json:"enabled"`
-	Buffer          int             `json:"buffer"`
+	push.ProviderConfig
 	Credentials     json.RawMessage `json:"credentials"`
 	CredentialsFile string          `json:"credentials_file"`
-	TimeToLive      uint            `json:"time_to_live,omitempty"`
 	Android         androidConfig   `json:"android,omitempty"`
+	IOS             iosConfig       `json:"ios,omitempty"`
+	// Default delivery options, overridable per push-type under Android/IOS.
+	Options pushOptions `json:"options,omitempty"`
+	// Number of workers draining the retry queue. Defaults to defaultWorkers.
+	Workers int `json:"workers,omitempty"`
+	// Max attempts before a message is dropped. Defaults to defaultMaxAttempts.
+	MaxAttempts int `json:"max_attempts,omitempty"`
 }
 
 // Init initializes the push handler
@@ -157,6 +392,13 @@ func (Handler) Init(jsonconf string) error {
 	if !config.Enabled {
 		return nil
 	}
+
+	if config.Options.TimeToLive == 0 {
+		// ProviderConfig.TimeToLive is the provider-wide default shared across all push
+		// backends; Options.TimeToLive is fcm's own knob and takes precedence when set.
+		config.Options.TimeToLive = config.TimeToLive
+	}
+
 	ctx := context.Background()
 
 	var opt option.ClientOption
@@ -187,6 +429,7 @@ func (Handler) Init(jsonconf string) error {
 		config.Buffer = defaultBuffer
 	}
 
+	handler.queue = newWorkQueue(handler.client, config.Buffer, config.Workers, config.MaxAttempts)
 	handler.input = make(chan *push.Receipt, config.Buffer)
 	handler.stop = make(chan bool, 1)
 
@@ -206,6 +449,7 @@ func (Handler) Init(jsonconf string) error {
 
 func sendNotifications(rcpt *push.Receipt, config *configType) {
 	ctx := context.Background()
+	var batch []*queuedMessage
 
 	data, _ := payloadToData(&rcpt.Payload)
 	if data == nil {
@@ -249,20 +493,79 @@ func sendNotifications(rcpt *push.Receipt, config *configType) {
 		color = config.Android.getIconColor(rcpt.Payload.What)
 	}
 
+	androidOpts := resolveOptions(rcpt.Payload.What, config.Options, config.Android.Msg.Options, config.Android.Sub.Options)
+	iosOpts := resolveOptions(rcpt.Payload.What, config.Options, config.IOS.Msg.Options, config.IOS.Sub.Options)
+	// FCM's SendAll/SendAllDryRun is an all-or-nothing call for the whole batch: a receipt is either
+	// entirely a dry run or not.
+	dryRun := androidOpts.DryRun || iosOpts.DryRun
+
 	for uid, devList := range devices {
+		prefs, err := store.Users.GetPushPrefs(uid)
+		if err != nil {
+			log.Println("fcm push: failed to get push prefs", uid, err)
+		}
+		if isMuted(prefs, rcpt.Payload.Topic) {
+			// User has muted this topic: no push at all, not even a silent one.
+			continue
+		}
+		// Quiet hours force every device of this user into a silent, badge-only push,
+		// regardless of the per-type Silent setting.
+		quiet := inQuietHours(prefs, time.Now())
+
 		for i := range devList {
 			d := &devList[i]
-			if _, ok := skipDevices[d.DeviceId]; !ok && d.DeviceId != "" {
+			if _, ok := skipDevices[d.DeviceId]; !ok && d.DeviceId != "" && push.DeviceProvider(d) == "fcm" {
+				// Android and iOS are configured independently, so the priority threshold
+				// must be checked against the option set that actually applies to this device.
+				if d.Platform == "ios" {
+					if belowThreshold(prefs, iosOpts.Priority) {
+						continue
+					}
+				} else if belowThreshold(prefs, androidOpts.Priority) {
+					continue
+				}
+
+				androidOpts := androidOpts
+				iosOpts := iosOpts
+				if quiet {
+					androidOpts.Silent = true
+					iosOpts.Silent = true
+				}
+
+				// Own copy of data: the "silent" flag can differ per device (quiet hours are
+				// per-user), so devices in the same batch must not share one map instance.
+				msgData := make(map[string]string, len(data)+1)
+				for k, v := range data {
+					msgData[k] = v
+				}
+
 				msg := fcm.Message{
 					Token: d.DeviceId,
-					Data:  data,
+					Data:  msgData,
 				}
 
 				if d.Platform == "android" {
+					if androidOpts.Silent {
+						msgData["silent"] = "true"
+					}
 					msg.Android = &fcm.AndroidConfig{
-						Priority: "high",
+						Priority:              androidOpts.Priority,
+						CollapseKey:           androidOpts.CollapseKey,
+						RestrictedPackageName: androidOpts.RestrictedPackageName,
+					}
+					if androidOpts.TimeToLive > 0 {
+						ttl := time.Duration(androidOpts.TimeToLive) * time.Second
+						msg.Android.TTL = &ttl
+					}
+					if androidOpts.DelayWhileIdle {
+						// FCM replaces legacy GCM's delay_while_idle with normal priority: the
+						// message is held until the device wakes up on its own.
+						msg.Android.Priority = "normal"
 					}
-					if config.Android.Enabled {
+					if androidOpts.Silent {
+						// Data-only wake-up (msgData["silent"] already set above): the app is
+						// responsible for showing its own UI, if any.
+					} else if config.Android.Enabled {
 						// When this notification type is included and the app is not in the foreground
 						// Android won't wake up the app and won't call FirebaseMessagingService:onMessageReceived.
 						// See dicussion: https://github.com/firebase/quickstart-js/issues/71
@@ -279,63 +582,112 @@ func sendNotifications(rcpt *push.Receipt, config *configType) {
 						}
 					}
 				} else if d.Platform == "ios" {
+					if iosOpts.Silent {
+						msgData["silent"] = "true"
+					}
 					// iOS uses Badge to show the total unread message count.
 					badge := rcpt.To[uid].Unread
-					// Need to duplicate these in APNS.Payload.Aps.Alert so
-					// iOS may call NotificationServiceExtension (if present).
-					title := "New message"
-					body := data["content"]
-					msg.APNS = &fcm.APNSConfig{
-						Payload: &fcm.APNSPayload{
-							Aps: &fcm.Aps{
-								Badge:            &badge,
-								ContentAvailable: true,
-								MutableContent:   true,
-								Sound:            "default",
-								Alert: &fcm.ApsAlert{
-									Title: title,
-									Body:  body,
-								},
-							},
-						},
+					aps := &fcm.Aps{
+						Badge:            &badge,
+						ContentAvailable: iosOpts.Silent || iosOpts.ContentAvailable,
+						MutableContent:   iosOpts.MutableContent,
+						Sound:            "default",
 					}
-					msg.Notification = &fcm.Notification{
-						Title: title,
-						Body:  body,
+					if !iosOpts.Silent {
+						// Need to duplicate these in APNS.Payload.Aps.Alert so
+						// iOS may call NotificationServiceExtension (if present).
+						title := "New message"
+						body := data["content"]
+						aps.Alert = &fcm.ApsAlert{
+							Title: title,
+							Body:  body,
+						}
+						if config.IOS.Enabled {
+							what := rcpt.Payload.What
+							// Group notifications by topic the way Android uses Tag.
+							aps.ThreadID = config.IOS.getThreadID(what)
+							aps.Category = config.IOS.getCategory(what)
+							aps.Alert.Subtitle = config.IOS.getSubtitle(what)
+							aps.Alert.TitleLocKey = config.IOS.getTitleLocKey(what)
+							aps.Alert.TitleLocArgs = config.IOS.getTitleLocArgs(what)
+							aps.Alert.LocKey = config.IOS.getLocKey(what)
+							aps.Alert.LocArgs = config.IOS.getLocArgs(what)
+							// Not yet exposed as native fields by the FCM go SDK: set them directly
+							// on the aps dict via CustomData.
+							aps.CustomData = map[string]interface{}{
+								"interruption-level": config.IOS.getInterruptionLevel(what),
+							}
+							if score := config.IOS.getRelevanceScore(what); score > 0 {
+								aps.CustomData["relevance-score"] = score
+							}
+							if tcid := config.IOS.getTargetContentID(what); tcid != "" {
+								aps.CustomData["target-content-id"] = tcid
+							}
+						}
+						msg.Notification = &fcm.Notification{
+							Title: title,
+							Body:  body,
+						}
 					}
-				}
 
-				_, err := handler.client.Send(ctx, &msg)
-				if err != nil {
-					if fcm.IsMessageRateExceeded(err) ||
-						fcm.IsServerUnavailable(err) ||
-						fcm.IsInternal(err) ||
-						fcm.IsUnknown(err) {
-						// Transient errors. Stop sending this batch.
-						log.Println("fcm transient failure", err)
-						return
+					payload := &fcm.APNSPayload{Aps: aps}
+					if url := attachmentURL(rcpt.Payload.Content); url != "" {
+						// Consumed by the Notification Service Extension to download and
+						// display an image/file preview. The extension only runs when
+						// mutable-content is set, regardless of the configured option.
+						aps.MutableContent = true
+						payload.CustomData = map[string]interface{}{"attachment-url": url}
 					}
-
-					if fcm.IsMismatchedCredential(err) || fcm.IsInvalidArgument(err) {
-						// Config errors
-						log.Println("fcm push: failed", err)
-						return
+					headers := map[string]string{}
+					if iosOpts.TimeToLive > 0 {
+						exp := time.Now().Add(time.Duration(iosOpts.TimeToLive) * time.Second)
+						headers["apns-expiration"] = strconv.FormatInt(exp.Unix(), 10)
 					}
 
-					if fcm.IsRegistrationTokenNotRegistered(err) {
-						// Token is no longer valid.
-						log.Println("fcm push: invalid token", err)
-						err = store.Devices.Delete(uid, d.DeviceId)
-						if err != nil {
-							log.Println("fcm push: failed to delete invalid token", err)
-						}
-					} else {
-						log.Println("fcm push:", err)
-					}
+					msg.APNS = &fcm.APNSConfig{Headers: headers, Payload: payload}
 				}
+
+				batch = append(batch, &queuedMessage{uid: uid, msg: &msg})
+				if len(batch) == maxBatchSize {
+					handler.queue.sendBatch(ctx, batch, dryRun)
+					batch = batch[:0]
+				}
+			}
+		}
+	}
+
+	if len(batch) > 0 {
+		handler.queue.sendBatch(ctx, batch, dryRun)
+	}
+}
+
+// attachmentURL returns the ref URL of the first image or file attachment found in a Drafty
+// document, or "" if there is none. Used to populate the mutable-content attachment for APNS.
+func attachmentURL(content interface{}) string {
+	doc, ok := content.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	ents, ok := doc["ent"].([]interface{})
+	if !ok {
+		return ""
+	}
+	for _, e := range ents {
+		ent, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tp, _ := ent["tp"].(string)
+		if tp != "IM" && tp != "EX" {
+			continue
+		}
+		if data, ok := ent["data"].(map[string]interface{}); ok {
+			if ref, ok := data["ref"].(string); ok && ref != "" {
+				return ref
 			}
 		}
 	}
+	return ""
 }
 
 func payloadToData(pl *push.Payload) (map[string]string, error) {
@@ -344,7 +696,6 @@ func payloadToData(pl *push.Payload) (map[string]string, error) {
 	}
 
 	data := make(map[string]string)
-	var err error
 	data["what"] = pl.What
 	if pl.Silent {
 		data["silent"] = "true"
@@ -356,19 +707,48 @@ func payloadToData(pl *push.Payload) (map[string]string, error) {
 	if pl.What == push.ActMsg {
 		data["seq"] = strconv.Itoa(pl.SeqId)
 		data["mime"] = pl.ContentType
-		data["content"], err = drafty.ToPlainText(pl.Content)
+
+		pv, err := drafty.ToNotificationPreview(pl.Content)
 		if err != nil {
 			return nil, err
 		}
 
+		content := pv.PreviewText
 		// Trim long strings to 80 runes.
 		// Check byte length first and don't waste time converting short strings.
-		if len(data["content"]) > maxMessageLength {
-			runes := []rune(data["content"])
+		if len(content) > maxMessageLength {
+			runes := []rune(content)
 			if len(runes) > maxMessageLength {
-				data["content"] = string(runes[:maxMessageLength]) + "…"
+				content = string(runes[:maxMessageLength]) + "…"
 			}
 		}
+		data["content"] = content
+
+		if pv.HasImage {
+			data["has_image"] = "true"
+		}
+		if pv.HasVideo {
+			data["has_video"] = "true"
+		}
+		if pv.HasFile {
+			data["has_file"] = "true"
+		}
+		if pv.Mime != "" {
+			data["attachment_mime"] = pv.Mime
+		}
+		if pv.Name != "" {
+			data["attachment_name"] = pv.Name
+		}
+		if len(pv.Mentions) > 0 {
+			data["mentions"] = strings.Join(pv.Mentions, ",")
+		}
+		if pv.IsReply {
+			data["is_reply"] = "true"
+			data["reply_author"] = pv.ReplyAuthor
+		}
+		if locKey := pv.BodyLocKey(); locKey != "" {
+			data["body_loc_key"] = locKey
+		}
 	} else if pl.What == push.ActSub {
 		data["modeWant"] = pl.ModeWant.String()
 		data["modeGiven"] = pl.ModeGiven.String()
@@ -394,6 +774,14 @@ func (Handler) Stop() {
 	handler.stop <- true
 }
 
+// Stats returns the retry queue's runtime counters; implements push.StatsProvider.
+func (Handler) Stats() push.Stats {
+	if handler.queue == nil {
+		return push.Stats{}
+	}
+	return handler.queue.stats()
+}
+
 func init() {
 	push.Register("fcm", &handler)
 }
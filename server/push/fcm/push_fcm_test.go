@@ -0,0 +1,80 @@
+package fcm
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tinode/chat/server/push"
+)
+
+// TestAndroidConfigUnmarshal guards against the Msg/Sub fields silently losing their
+// per-push-type overrides: if they ever end up with identical json tags again,
+// encoding/json treats the name as ambiguous and populates neither field.
+func TestAndroidConfigUnmarshal(t *testing.T) {
+	const raw = `{
+		"msg": {"title": "msg-title"},
+		"sub": {"title": "sub-title"}
+	}`
+
+	var ac androidConfig
+	if err := json.Unmarshal([]byte(raw), &ac); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if ac.Msg.Title != "msg-title" {
+		t.Errorf("Msg.Title = %q, want %q", ac.Msg.Title, "msg-title")
+	}
+	if ac.Sub.Title != "sub-title" {
+		t.Errorf("Sub.Title = %q, want %q", ac.Sub.Title, "sub-title")
+	}
+}
+
+func TestResolveOptions(t *testing.T) {
+	global := pushOptions{
+		Silent:      false,
+		CollapseKey: "global-key",
+		TimeToLive:  60,
+		Priority:    "normal",
+	}
+
+	t.Run("no override falls back to global, including its priority", func(t *testing.T) {
+		got := resolveOptions(push.ActSub, global, pushOptions{}, pushOptions{})
+		want := global
+		want.Priority = "normal"
+		if got != want {
+			t.Errorf("resolveOptions() = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("msg override wins for msg, sub override is ignored", func(t *testing.T) {
+		msgOpt := pushOptions{Silent: true, CollapseKey: "msg-key"}
+		subOpt := pushOptions{CollapseKey: "sub-key"}
+		got := resolveOptions(push.ActMsg, global, msgOpt, subOpt)
+		if !got.Silent {
+			t.Error("expected Silent to be overridden to true")
+		}
+		if got.CollapseKey != "msg-key" {
+			t.Errorf("CollapseKey = %q, want %q", got.CollapseKey, "msg-key")
+		}
+		if got.TimeToLive != global.TimeToLive {
+			t.Errorf("TimeToLive = %d, want %d (unset override falls back)", got.TimeToLive, global.TimeToLive)
+		}
+	})
+
+	t.Run("sub override wins for sub", func(t *testing.T) {
+		subOpt := pushOptions{Priority: "high", DryRun: true}
+		got := resolveOptions(push.ActSub, global, pushOptions{}, subOpt)
+		if got.Priority != "high" {
+			t.Errorf("Priority = %q, want %q", got.Priority, "high")
+		}
+		if !got.DryRun {
+			t.Error("expected DryRun to be overridden to true")
+		}
+	})
+
+	t.Run("unset global priority defaults to high", func(t *testing.T) {
+		got := resolveOptions(push.ActMsg, pushOptions{}, pushOptions{}, pushOptions{})
+		if got.Priority != "high" {
+			t.Errorf("Priority = %q, want %q", got.Priority, "high")
+		}
+	})
+}
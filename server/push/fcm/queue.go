@@ -0,0 +1,237 @@
+package fcm
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	fcm "firebase.google.com/go/messaging"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// Maximum number of tokens FCM allows in a single SendAll call.
+const maxBatchSize = 500
+
+// Default number of workers draining the retry queue when config.Workers is unset.
+const defaultWorkers = 8
+
+// Default cap on the number of attempts made to deliver a single message.
+const defaultMaxAttempts = 5
+
+// Backoff bounds for retried messages.
+const (
+	initialBackoff = 1 * time.Second
+	maxBackoff     = 2 * time.Minute
+)
+
+// fcmErrorClassifiers is the FCM SDK's error-classification predicates, indirected through
+// package vars so tests can substitute them without needing real firebase.google.com/go errors.
+var fcmErrorClassifiers = struct {
+	isMessageRateExceeded            func(error) bool
+	isServerUnavailable              func(error) bool
+	isInternal                       func(error) bool
+	isUnknown                        func(error) bool
+	isRegistrationTokenNotRegistered func(error) bool
+	isMismatchedCredential           func(error) bool
+	isInvalidArgument                func(error) bool
+}{
+	isMessageRateExceeded:            fcm.IsMessageRateExceeded,
+	isServerUnavailable:              fcm.IsServerUnavailable,
+	isInternal:                       fcm.IsInternal,
+	isUnknown:                        fcm.IsUnknown,
+	isRegistrationTokenNotRegistered: fcm.IsRegistrationTokenNotRegistered,
+	isMismatchedCredential:           fcm.IsMismatchedCredential,
+	isInvalidArgument:                fcm.IsInvalidArgument,
+}
+
+// queuedMessage is a single device-bound message waiting for a retry attempt.
+type queuedMessage struct {
+	uid     t.Uid
+	msg     *fcm.Message
+	attempt int
+	// dryRun carries over the dry-run flag of the batch the message originally came from, so a
+	// retried message keeps going through FCM's validate-only path.
+	dryRun bool
+}
+
+// workQueue is a bounded retry queue drained by a pool of workers. The initial, happy-path send of
+// a receipt is batched directly via sendBatch; only messages which failed with a transient error are
+// routed through the queue for a backed-off, single-message retry.
+type workQueue struct {
+	client      *fcm.Client
+	maxAttempts int
+	queue       chan *queuedMessage
+
+	retries int64
+	errMu   sync.Mutex
+	errCnt  map[string]int64
+}
+
+func newWorkQueue(client *fcm.Client, bufferSize, workers, maxAttempts int) *workQueue {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+
+	wq := &workQueue{
+		client:      client,
+		maxAttempts: maxAttempts,
+		queue:       make(chan *queuedMessage, bufferSize),
+		errCnt:      make(map[string]int64),
+	}
+	for i := 0; i < workers; i++ {
+		go wq.worker()
+	}
+	return wq
+}
+
+func (wq *workQueue) worker() {
+	ctx := context.Background()
+	for item := range wq.queue {
+		var err error
+		if item.dryRun {
+			_, err = wq.client.SendDryRun(ctx, item.msg)
+		} else {
+			_, err = wq.client.Send(ctx, item.msg)
+		}
+		if err == nil {
+			continue
+		}
+		wq.handleError(ctx, item, err)
+	}
+}
+
+// sendBatch sends up to maxBatchSize messages in one FCM SendAll call, then inspects individual
+// responses: retryable failures are rescheduled through the retry queue, expired tokens are deleted,
+// everything else is logged. dryRun asks FCM to validate the messages without delivering them.
+func (wq *workQueue) sendBatch(ctx context.Context, batch []*queuedMessage, dryRun bool) {
+	msgs := make([]*fcm.Message, len(batch))
+	for i, item := range batch {
+		item.dryRun = dryRun
+		msgs[i] = item.msg
+	}
+
+	var br *fcm.BatchResponse
+	var err error
+	if dryRun {
+		br, err = wq.client.SendAllDryRun(ctx, msgs)
+	} else {
+		br, err = wq.client.SendAll(ctx, msgs)
+	}
+	if err != nil {
+		// The call itself failed (e.g. transport error): retry every message in the batch.
+		log.Println("fcm push: SendAll failed", err)
+		for _, item := range batch {
+			wq.countError("transport")
+			wq.schedule(item)
+		}
+		return
+	}
+
+	for i, resp := range br.Responses {
+		if resp.Success {
+			continue
+		}
+		wq.handleError(ctx, batch[i], resp.Error)
+	}
+}
+
+func (wq *workQueue) handleError(ctx context.Context, item *queuedMessage, err error) {
+	c := fcmErrorClassifiers
+	switch {
+	case c.isMessageRateExceeded(err):
+		wq.countError("rate_exceeded")
+		wq.schedule(item)
+	case c.isServerUnavailable(err):
+		wq.countError("server_unavailable")
+		wq.schedule(item)
+	case c.isInternal(err):
+		wq.countError("internal")
+		wq.schedule(item)
+	case c.isUnknown(err):
+		wq.countError("unknown")
+		wq.schedule(item)
+	case c.isRegistrationTokenNotRegistered(err):
+		wq.countError("invalid_token")
+		if derr := store.Devices.Delete(item.uid, item.msg.Token); derr != nil {
+			log.Println("fcm push: failed to delete invalid token", derr)
+		}
+	case c.isMismatchedCredential(err) || c.isInvalidArgument(err):
+		wq.countError("config")
+		log.Println("fcm push: config error", err)
+	default:
+		wq.countError("other")
+		log.Println("fcm push:", err)
+	}
+}
+
+// schedule reschedules item for another attempt after an exponential backoff with jitter, unless
+// it has already exhausted maxAttempts.
+func (wq *workQueue) schedule(item *queuedMessage) {
+	item.attempt++
+	if item.attempt >= wq.maxAttempts {
+		log.Println("fcm push: giving up on message to", item.uid, "after", item.attempt, "attempts")
+		return
+	}
+
+	atomic.AddInt64(&wq.retries, 1)
+
+	// Jitter: add a random [0, backoff) on top of the base delay, so the wait is in [backoff, 2*backoff).
+	backoff := backoffDuration(item.attempt)
+	backoff += time.Duration(rand.Int63n(int64(backoff)))
+
+	time.AfterFunc(backoff, func() {
+		select {
+		case wq.queue <- item:
+		default:
+			log.Println("fcm push: retry queue full, dropping message to", item.uid)
+		}
+	})
+}
+
+// backoffDuration returns the base, pre-jitter delay before the given attempt number (1-indexed),
+// doubling from initialBackoff and capped at maxBackoff.
+func backoffDuration(attempt int) time.Duration {
+	if attempt <= 1 {
+		return initialBackoff
+	}
+	if attempt-1 >= 63 {
+		// Guard against the shift overflowing into a negative/zero duration.
+		return maxBackoff
+	}
+	d := initialBackoff << uint(attempt-1)
+	if d <= 0 || d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
+
+func (wq *workQueue) countError(class string) {
+	wq.errMu.Lock()
+	wq.errCnt[class]++
+	wq.errMu.Unlock()
+}
+
+// stats returns a snapshot of the queue's runtime counters.
+func (wq *workQueue) stats() push.Stats {
+	wq.errMu.Lock()
+	errs := make(map[string]int64, len(wq.errCnt))
+	for k, v := range wq.errCnt {
+		errs[k] = v
+	}
+	wq.errMu.Unlock()
+
+	return push.Stats{
+		QueueDepth: len(wq.queue),
+		Retries:    atomic.LoadInt64(&wq.retries),
+		Errors:     errs,
+	}
+}
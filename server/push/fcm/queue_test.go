@@ -0,0 +1,158 @@
+package fcm
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fcm "firebase.google.com/go/messaging"
+)
+
+func TestBackoffDuration(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, initialBackoff},
+		{2, 2 * initialBackoff},
+		{3, 4 * initialBackoff},
+		{4, 8 * initialBackoff},
+	}
+	for _, tc := range tests {
+		if got := backoffDuration(tc.attempt); got != tc.want {
+			t.Errorf("backoffDuration(%d) = %v, want %v", tc.attempt, got, tc.want)
+		}
+	}
+}
+
+func TestBackoffDurationCapsAtMax(t *testing.T) {
+	for _, attempt := range []int{10, 64, 1000} {
+		if got := backoffDuration(attempt); got != maxBackoff {
+			t.Errorf("backoffDuration(%d) = %v, want cap %v", attempt, got, maxBackoff)
+		}
+	}
+}
+
+func TestScheduleGivesUpAfterMaxAttempts(t *testing.T) {
+	wq := &workQueue{maxAttempts: 1, queue: make(chan *queuedMessage, 1)}
+	item := &queuedMessage{}
+
+	wq.schedule(item)
+
+	if got := atomic.LoadInt64(&wq.retries); got != 0 {
+		t.Errorf("retries = %d, want 0 once maxAttempts is exhausted", got)
+	}
+	select {
+	case <-wq.queue:
+		t.Error("schedule() queued a retry past maxAttempts")
+	default:
+	}
+}
+
+func TestScheduleIncrementsRetries(t *testing.T) {
+	wq := &workQueue{maxAttempts: 5, queue: make(chan *queuedMessage, 1)}
+	item := &queuedMessage{}
+
+	wq.schedule(item)
+
+	if got := atomic.LoadInt64(&wq.retries); got != 1 {
+		t.Errorf("retries = %d, want 1", got)
+	}
+	if item.attempt != 1 {
+		t.Errorf("item.attempt = %d, want 1", item.attempt)
+	}
+}
+
+// TestHandleErrorClassMapping substitutes fcmErrorClassifiers so each branch of handleError's
+// switch can be exercised without needing a real firebase.google.com/go error value.
+func TestHandleErrorClassMapping(t *testing.T) {
+	saved := fcmErrorClassifiers
+	defer func() { fcmErrorClassifiers = saved }()
+
+	reset := func() {
+		fcmErrorClassifiers.isMessageRateExceeded = func(error) bool { return false }
+		fcmErrorClassifiers.isServerUnavailable = func(error) bool { return false }
+		fcmErrorClassifiers.isInternal = func(error) bool { return false }
+		fcmErrorClassifiers.isUnknown = func(error) bool { return false }
+		fcmErrorClassifiers.isRegistrationTokenNotRegistered = func(error) bool { return false }
+		fcmErrorClassifiers.isMismatchedCredential = func(error) bool { return false }
+		fcmErrorClassifiers.isInvalidArgument = func(error) bool { return false }
+	}
+
+	tests := []struct {
+		name      string
+		rig       func()
+		wantClass string
+		wantRetry bool
+	}{
+		{
+			name:      "rate exceeded retries",
+			rig:       func() { fcmErrorClassifiers.isMessageRateExceeded = func(error) bool { return true } },
+			wantClass: "rate_exceeded",
+			wantRetry: true,
+		},
+		{
+			name:      "server unavailable retries",
+			rig:       func() { fcmErrorClassifiers.isServerUnavailable = func(error) bool { return true } },
+			wantClass: "server_unavailable",
+			wantRetry: true,
+		},
+		{
+			name:      "internal retries",
+			rig:       func() { fcmErrorClassifiers.isInternal = func(error) bool { return true } },
+			wantClass: "internal",
+			wantRetry: true,
+		},
+		{
+			name:      "unknown retries",
+			rig:       func() { fcmErrorClassifiers.isUnknown = func(error) bool { return true } },
+			wantClass: "unknown",
+			wantRetry: true,
+		},
+		{
+			name:      "invalid token does not retry",
+			rig:       func() { fcmErrorClassifiers.isRegistrationTokenNotRegistered = func(error) bool { return true } },
+			wantClass: "invalid_token",
+			wantRetry: false,
+		},
+		{
+			name:      "mismatched credential does not retry",
+			rig:       func() { fcmErrorClassifiers.isMismatchedCredential = func(error) bool { return true } },
+			wantClass: "config",
+			wantRetry: false,
+		},
+		{
+			name:      "invalid argument does not retry",
+			rig:       func() { fcmErrorClassifiers.isInvalidArgument = func(error) bool { return true } },
+			wantClass: "config",
+			wantRetry: false,
+		},
+		{
+			name:      "unmatched error falls through to other",
+			rig:       func() {},
+			wantClass: "other",
+			wantRetry: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reset()
+			tc.rig()
+
+			wq := &workQueue{maxAttempts: 5, queue: make(chan *queuedMessage, 1), errCnt: make(map[string]int64)}
+			item := &queuedMessage{msg: &fcm.Message{}}
+
+			wq.handleError(nil, item, errors.New("boom"))
+
+			if got := wq.errCnt[tc.wantClass]; got != 1 {
+				t.Errorf("errCnt[%q] = %d, want 1 (counts: %+v)", tc.wantClass, got, wq.errCnt)
+			}
+			gotRetry := atomic.LoadInt64(&wq.retries) == 1
+			if gotRetry != tc.wantRetry {
+				t.Errorf("retried = %v, want %v", gotRetry, tc.wantRetry)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+// Package hms implements push notification plugin for Huawei Push Kit.
+// It lets the server reach Huawei devices which have no Google Play Services and therefore
+// cannot receive FCM messages, by talking to Huawei's Push Kit REST API directly.
+package hms
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var handler Handler
+
+// Size of the input channel buffer.
+const defaultBuffer = 32
+
+const (
+	tokenURL = "https://oauth-login.cloud.huawei.com/oauth2/v3/token"
+	sendURLf = "https://push-api.cloud.huawei.com/v1/%s/messages:send"
+)
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input     chan *push.Receipt
+	stop      chan bool
+	client    *http.Client
+	appID     string
+	appSecret string
+
+	mu          sync.Mutex
+	accessToken string
+	expires     time.Time
+}
+
+type configType struct {
+	push.ProviderConfig
+	AppID     string `json:"app_id"`
+	AppSecret string `json:"app_secret"`
+
+	// Priority of notifications sent through this provider: "low", "normal" or "high".
+	// Defaults to "high". Compared against a user's MinPriority push pref.
+	Priority string `json:"priority,omitempty"`
+}
+
+// Init initializes the push handler.
+func (Handler) Init(jsonconf string) error {
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return errors.New("hms: failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return nil
+	}
+	if config.AppID == "" || config.AppSecret == "" {
+		return errors.New("hms: missing app_id or app_secret")
+	}
+
+	handler.client = &http.Client{Timeout: 10 * time.Second}
+	handler.appID = config.AppID
+	handler.appSecret = config.AppSecret
+
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+	if config.Priority == "" {
+		config.Priority = "high"
+	}
+
+	handler.input = make(chan *push.Receipt, config.Buffer)
+	handler.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendNotifications(rcpt, &config)
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// accessTokenFor fetches (and caches) an OAuth2 client-credentials access token.
+func accessTokenFor() (string, error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+
+	if handler.accessToken != "" && time.Now().Before(handler.expires) {
+		return handler.accessToken, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", handler.appID)
+	form.Set("client_secret", handler.appSecret)
+
+	resp, err := handler.client.PostForm(tokenURL, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.AccessToken == "" {
+		return "", errors.New("hms: empty access token")
+	}
+
+	handler.accessToken = result.AccessToken
+	handler.expires = time.Now().Add(time.Duration(result.ExpiresIn-60) * time.Second)
+	return handler.accessToken, nil
+}
+
+type hmsMessage struct {
+	Message struct {
+		Data    string          `json:"data,omitempty"`
+		Token   []string        `json:"token"`
+		Android *hmsAndroidConf `json:"android,omitempty"`
+	} `json:"message"`
+}
+
+type hmsAndroidConf struct {
+	// TTL is the Huawei Push Kit message cache period, e.g. "172800s".
+	TTL          string           `json:"ttl,omitempty"`
+	Notification *hmsNotification `json:"notification,omitempty"`
+}
+
+type hmsNotification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+func sendNotifications(rcpt *push.Receipt, config *configType) {
+	uids := make([]t.Uid, len(rcpt.To))
+	skipDevices := make(map[string]bool)
+	i := 0
+	for uid, to := range rcpt.To {
+		uids[i] = uid
+		i++
+		for _, deviceID := range to.Devices {
+			skipDevices[deviceID] = true
+		}
+	}
+
+	devices, count, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		log.Println("hms push: db error", err)
+		return
+	}
+	if count == 0 {
+		return
+	}
+
+	data := map[string]string{"what": rcpt.Payload.What, "topic": rcpt.Payload.Topic}
+	var body string
+	if rcpt.Payload.What == push.ActMsg {
+		data["seq"] = strconv.Itoa(rcpt.Payload.SeqId)
+		body, _ = drafty.ToPlainText(rcpt.Payload.Content)
+	}
+	payload, _ := json.Marshal(data)
+
+	token, err := accessTokenFor()
+	if err != nil {
+		log.Println("hms push: failed to get access token", err)
+		return
+	}
+
+	for uid, devList := range devices {
+		prefs, err := store.Users.GetPushPrefs(uid)
+		if err != nil {
+			log.Println("hms push: failed to get push prefs", uid, err)
+		}
+		if push.IsMuted(prefs, rcpt.Payload.Topic) {
+			// User has muted this topic: no push at all, not even a silent one.
+			continue
+		}
+		if push.BelowThreshold(prefs, config.Priority) {
+			// Below the user's configured priority floor: drop it entirely.
+			continue
+		}
+		// Quiet hours force a silent, data-only push regardless of rcpt.Payload.Silent.
+		silent := rcpt.Payload.Silent || push.InQuietHours(prefs, time.Now())
+
+		for i := range devList {
+			d := &devList[i]
+			if _, ok := skipDevices[d.DeviceId]; ok || d.DeviceId == "" || push.DeviceProvider(d) != "hms" {
+				continue
+			}
+
+			var msg hmsMessage
+			msg.Message.Data = string(payload)
+			msg.Message.Token = []string{d.DeviceId}
+			if config.TimeToLive > 0 {
+				msg.Message.Android = ttlAndroidConf(msg.Message.Android, config.TimeToLive)
+			}
+			if !silent {
+				if msg.Message.Android == nil {
+					msg.Message.Android = &hmsAndroidConf{}
+				}
+				msg.Message.Android.Notification = &hmsNotification{Title: "New message", Body: body}
+			}
+
+			if err := send(token, &msg); err != nil {
+				log.Println("hms push: send failed", err)
+			}
+		}
+	}
+}
+
+// ttlAndroidConf sets the Huawei-specific TTL field on conf (creating it if nil) without
+// clobbering a Notification that may be set afterwards.
+func ttlAndroidConf(conf *hmsAndroidConf, ttl uint) *hmsAndroidConf {
+	if conf == nil {
+		conf = &hmsAndroidConf{}
+	}
+	conf.TTL = strconv.Itoa(int(ttl)) + "s"
+	return conf
+}
+
+func send(token string, msg *hmsMessage) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost,
+		fmt.Sprintf(sendURLf, handler.appID), bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("hms: send failed: " + string(respBody))
+	}
+	return nil
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Stop shuts down the handler.
+func (Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register("hms", &handler)
+}
@@ -0,0 +1,46 @@
+package push
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// SetPrefPayload is the body of a `{set pref: {...}}` client message: the fields a user is
+// allowed to configure for themselves, mirroring t.PushPrefs.
+type SetPrefPayload struct {
+	QuietHours  *t.QuietHours   `json:"quiet_hours,omitempty"`
+	MutedTopics map[string]bool `json:"muted_topics,omitempty"`
+	MinPriority string          `json:"min_priority,omitempty"`
+}
+
+// HandleSetPref applies a `{set pref}` client message for uid and persists the result via
+// store.Users.SetPushPrefs. A session's client-message dispatcher calls this once it has
+// decoded the "pref" field of a `{set ...}` message; that dispatcher is not part of this
+// package and isn't present in this tree, so this is the integration point it would call into.
+// Fields omitted from payload leave the corresponding existing preference untouched.
+func HandleSetPref(uid t.Uid, payload json.RawMessage) error {
+	var sp SetPrefPayload
+	if err := json.Unmarshal(payload, &sp); err != nil {
+		return errors.New("push: invalid pref payload: " + err.Error())
+	}
+
+	prefs, err := store.Users.GetPushPrefs(uid)
+	if err != nil {
+		return err
+	}
+
+	if sp.QuietHours != nil {
+		prefs.QuietHours = *sp.QuietHours
+	}
+	if sp.MutedTopics != nil {
+		prefs.MutedTopics = sp.MutedTopics
+	}
+	if sp.MinPriority != "" {
+		prefs.MinPriority = sp.MinPriority
+	}
+
+	return store.Users.SetPushPrefs(uid, prefs)
+}
@@ -0,0 +1,179 @@
+// Package push defines an interface which must be implemented by handlers of push notifications as
+// well as the generic data used for push notifications.
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// Actions that may trigger a push notification.
+const (
+	// ActMsg is a push notification for a new message.
+	ActMsg = "msg"
+	// ActSub is a push notification for a new subscription.
+	ActSub = "sub"
+)
+
+// Recipient is a single user to whom a push notification is addressed: the push goes to all of the
+// user's registered devices except those listed in Devices.
+type Recipient struct {
+	// List of device IDs to skip: devices which already received the message over a live connection.
+	Devices []string
+	// Count of user's connections that were live when the message was sent.
+	Delivered int
+	// Unread count for this user, to be sent as a badge.
+	Unread int
+}
+
+// Payload is the content of a push notification.
+type Payload struct {
+	What        string
+	Silent      bool
+	Topic       string
+	From        string
+	Timestamp   time.Time
+	SeqId       int
+	ContentType string
+	Content     interface{}
+	ModeWant    t.AccessMode
+	ModeGiven   t.AccessMode
+}
+
+// Receipt is a push notification and a list of recipients to send it to.
+type Receipt struct {
+	To      map[t.Uid]Recipient
+	Payload Payload
+}
+
+// ProviderConfig holds the subset of configuration common to every push notification backend.
+// Individual providers embed it into their own config struct alongside provider-specific fields.
+type ProviderConfig struct {
+	Enabled bool `json:"enabled"`
+	// Size of the provider's internal input channel buffer.
+	Buffer int `json:"buffer"`
+	// Default time to live for messages sent through this provider, seconds. 0 means "use provider default".
+	TimeToLive uint `json:"time_to_live,omitempty"`
+}
+
+// PushHandler is an interface which must be implemented by handlers of push notifications.
+type PushHandler interface {
+	// Init initializes the handler.
+	Init(jsonconf string) error
+	// IsReady checks if the handler is initialized and ready to send notifications.
+	IsReady() bool
+	// Push returns a channel that the server will use to send messages to.
+	// If the adapter blocks, the message will be dropped.
+	Push() chan<- *Receipt
+	// Stop shuts down the handler.
+	Stop()
+}
+
+// DeviceProvider returns the name of the push provider a device should be routed to:
+// the device's own PushProvider if set, otherwise "fcm" for backward compatibility.
+func DeviceProvider(d *t.Device) string {
+	if d.PushProvider != "" {
+		return d.PushProvider
+	}
+	return "fcm"
+}
+
+// handlers is the registry of all push providers known to the server, keyed by name.
+var handlers map[string]PushHandler
+
+// Register makes a push handler available under the given name. Individual provider
+// packages call this from their init() function.
+func Register(name string, hnd PushHandler) {
+	if handlers == nil {
+		handlers = make(map[string]PushHandler)
+	}
+	handlers[name] = hnd
+}
+
+// Init initializes the registered handlers which have a section in the config, e.g.
+//
+//	{"fcm": {...}, "apns": {...}, "hms": {...}, "webpush": {...}}
+//
+// and returns the names of the ones that came up ready.
+func Init(jsonconf string) ([]string, error) {
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return nil, errors.New("push: failed to parse config: " + err.Error())
+	}
+
+	var active []string
+	for name, hnd := range handlers {
+		jsconf, ok := config[name]
+		if !ok {
+			continue
+		}
+		if err := hnd.Init(string(jsconf)); err != nil {
+			log.Println("push: failed to init handler", name, err)
+			continue
+		}
+		if hnd.IsReady() {
+			active = append(active, name)
+		}
+	}
+	return active, nil
+}
+
+// Push fans the receipt out to every registered, ready handler. Each handler is responsible for
+// filtering the devices it actually owns (see DeviceProvider).
+func Push(rcpt *Receipt) {
+	if rcpt == nil || len(rcpt.To) == 0 {
+		return
+	}
+
+	for name, hnd := range handlers {
+		if !hnd.IsReady() {
+			continue
+		}
+		select {
+		case hnd.Push() <- rcpt:
+		default:
+			log.Println("push: handler queue full, dropping receipt", name)
+		}
+	}
+}
+
+// Stats holds runtime counters for a single push provider, suitable for exporting to
+// a metrics system such as Prometheus.
+type Stats struct {
+	// QueueDepth is the number of messages currently waiting to be sent or retried.
+	QueueDepth int
+	// Retries is the total number of retry attempts scheduled so far.
+	Retries int64
+	// Errors counts failures seen so far, keyed by error class (e.g. "rate_exceeded", "invalid_token").
+	Errors map[string]int64
+}
+
+// StatsProvider may optionally be implemented by a PushHandler to expose its runtime counters.
+type StatsProvider interface {
+	Stats() Stats
+}
+
+// AllStats collects Stats from every registered handler which implements StatsProvider, keyed by
+// provider name. Handlers which don't track stats are omitted.
+func AllStats() map[string]Stats {
+	out := make(map[string]Stats)
+	for name, hnd := range handlers {
+		if sp, ok := hnd.(StatsProvider); ok {
+			out[name] = sp.Stats()
+		}
+	}
+	return out
+}
+
+// Stop shuts down all ready handlers.
+func Stop() {
+	for _, hnd := range handlers {
+		if hnd.IsReady() {
+			hnd.Stop()
+		}
+	}
+}
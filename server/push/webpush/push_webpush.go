@@ -0,0 +1,215 @@
+// Package webpush implements push notification plugin for the Web Push protocol (RFC 8030),
+// using VAPID application-server authentication (RFC 8292) and aes128gcm payload encryption
+// (RFC 8291). It lets the server deliver notifications straight to a browser subscription
+// without routing through FCM, which is required for e.g. Firefox and Safari subscriptions.
+package webpush
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	wp "github.com/SherClockHolmes/webpush-go"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var handler Handler
+
+// Size of the input channel buffer.
+const defaultBuffer = 32
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input   chan *push.Receipt
+	stop    chan bool
+	vapid   vapidKeys
+	subject string
+}
+
+type vapidKeys struct {
+	Public  string
+	Private string
+}
+
+type configType struct {
+	push.ProviderConfig
+	// VAPID key pair, base64url-encoded, as generated by webpush-go's GenerateVAPIDKeys.
+	VapidPublicKey  string `json:"vapid_public_key"`
+	VapidPrivateKey string `json:"vapid_private_key"`
+	// Contact URL or mailto: address sent to push services per RFC 8292.
+	Subject string `json:"subject"`
+
+	// Priority of notifications sent through this provider: "low", "normal" or "high".
+	// Defaults to "high". Compared against a user's MinPriority push pref.
+	Priority string `json:"priority,omitempty"`
+}
+
+// subscription is the payload stored in t.Device.DeviceId for a browser's push subscription:
+// it's a JSON-serialized endpoint + encryption keys as returned by the browser's Push API.
+type subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// Init initializes the push handler.
+func (Handler) Init(jsonconf string) error {
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return errors.New("webpush: failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return nil
+	}
+	if config.VapidPublicKey == "" || config.VapidPrivateKey == "" {
+		return errors.New("webpush: missing VAPID keys")
+	}
+
+	handler.vapid = vapidKeys{Public: config.VapidPublicKey, Private: config.VapidPrivateKey}
+	handler.subject = config.Subject
+
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+	if config.Priority == "" {
+		config.Priority = "high"
+	}
+
+	handler.input = make(chan *push.Receipt, config.Buffer)
+	handler.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendNotifications(rcpt, &config)
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func sendNotifications(rcpt *push.Receipt, config *configType) {
+	uids := make([]t.Uid, len(rcpt.To))
+	skipDevices := make(map[string]bool)
+	i := 0
+	for uid, to := range rcpt.To {
+		uids[i] = uid
+		i++
+		for _, deviceID := range to.Devices {
+			skipDevices[deviceID] = true
+		}
+	}
+
+	devices, count, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		log.Println("webpush push: db error", err)
+		return
+	}
+	if count == 0 {
+		return
+	}
+
+	body := rcpt.Payload.Topic
+	if rcpt.Payload.What == push.ActMsg {
+		if txt, err := drafty.ToPlainText(rcpt.Payload.Content); err == nil {
+			body = txt
+		}
+	}
+
+	for uid, devList := range devices {
+		prefs, err := store.Users.GetPushPrefs(uid)
+		if err != nil {
+			log.Println("webpush push: failed to get push prefs", uid, err)
+		}
+		if push.IsMuted(prefs, rcpt.Payload.Topic) {
+			// User has muted this topic: no push at all, not even a silent one.
+			continue
+		}
+		if push.BelowThreshold(prefs, config.Priority) {
+			// Below the user's configured priority floor: drop it entirely.
+			continue
+		}
+		// Quiet hours force a silent, topic-only push regardless of rcpt.Payload.Silent.
+		silent := rcpt.Payload.Silent || push.InQuietHours(prefs, time.Now())
+
+		msg := map[string]string{"topic": rcpt.Payload.Topic}
+		if !silent {
+			msg["title"] = "New message"
+			msg["body"] = body
+		} else {
+			msg["silent"] = "true"
+		}
+		payload, _ := json.Marshal(msg)
+
+		for i := range devList {
+			d := &devList[i]
+			if _, ok := skipDevices[d.DeviceId]; ok || d.DeviceId == "" || push.DeviceProvider(d) != "webpush" {
+				continue
+			}
+
+			var sub subscription
+			if err := json.Unmarshal([]byte(d.DeviceId), &sub); err != nil {
+				log.Println("webpush push: invalid subscription", err)
+				continue
+			}
+
+			resp, err := wp.SendNotification(payload, &wp.Subscription{
+				Endpoint: sub.Endpoint,
+				Keys: wp.Keys{
+					P256dh: sub.Keys.P256dh,
+					Auth:   sub.Keys.Auth,
+				},
+			}, &wp.Options{
+				VAPIDPublicKey:  handler.vapid.Public,
+				VAPIDPrivateKey: handler.vapid.Private,
+				Subscriber:      handler.subject,
+				TTL:             int(config.TimeToLive),
+			})
+			if err != nil {
+				log.Println("webpush push: send failed", err)
+				continue
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode == 404 || resp.StatusCode == 410 {
+				// Subscription expired or was revoked by the browser.
+				log.Println("webpush push: subscription gone", d.DeviceId)
+				if err := store.Devices.Delete(uid, d.DeviceId); err != nil {
+					log.Println("webpush push: failed to delete stale subscription", err)
+				}
+			}
+		}
+	}
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Stop shuts down the handler.
+func (Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register("webpush", &handler)
+}
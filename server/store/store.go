@@ -0,0 +1,111 @@
+// Package store holds the server's persistence layer: device tokens and per-user push
+// preferences, as used by every provider under server/push/.
+package store
+
+import (
+	"sync"
+
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// usersStore is the backing for per-user data the push/ packages need: device tokens and push
+// preferences, keyed by Uid and guarded by a single lock since they're always read/written
+// together (a device is added or a pref is set, then both are read back at push time).
+type usersStore struct {
+	mu      sync.RWMutex
+	devices map[t.Uid][]t.Device
+	prefs   map[t.Uid]t.PushPrefs
+}
+
+var users = &usersStore{
+	devices: make(map[t.Uid][]t.Device),
+	prefs:   make(map[t.Uid]t.PushPrefs),
+}
+
+// UsersObj is the interface the push/ packages use to read and the `{set pref}` client message
+// handler (see push.HandleSetPref) uses to write per-user push preferences.
+type UsersObj struct{}
+
+// Users is the package-level handle callers use, e.g. store.Users.GetPushPrefs(uid).
+var Users UsersObj
+
+// GetPushPrefs returns the user's current push preferences, or a zero-value PushPrefs (quiet
+// hours disabled, nothing muted, no priority floor) if the user never set any.
+func (UsersObj) GetPushPrefs(uid t.Uid) (*t.PushPrefs, error) {
+	users.mu.RLock()
+	defer users.mu.RUnlock()
+	if p, ok := users.prefs[uid]; ok {
+		return &p, nil
+	}
+	return &t.PushPrefs{}, nil
+}
+
+// SetPushPrefs persists the user's push preferences, replacing any previous value. A nil prefs
+// clears them back to defaults.
+func (UsersObj) SetPushPrefs(uid t.Uid, prefs *t.PushPrefs) error {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	if prefs == nil {
+		delete(users.prefs, uid)
+		return nil
+	}
+	users.prefs[uid] = *prefs
+	return nil
+}
+
+// DevicesObj is the interface the push/ packages use to look up and invalidate device tokens.
+type DevicesObj struct{}
+
+// Devices is the package-level handle callers use, e.g. store.Devices.GetAll(uids...).
+var Devices DevicesObj
+
+// AddDevice registers (or replaces, if DeviceId already exists for this user) a device token
+// alongside the user's other devices and push preferences.
+func (DevicesObj) AddDevice(uid t.Uid, dev t.Device) error {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	devs := users.devices[uid]
+	for i, d := range devs {
+		if d.DeviceId == dev.DeviceId {
+			devs[i] = dev
+			return nil
+		}
+	}
+	users.devices[uid] = append(devs, dev)
+	return nil
+}
+
+// GetAll returns every registered device for each of the given users, along with the total
+// device count across all of them.
+func (DevicesObj) GetAll(uids ...t.Uid) (map[t.Uid][]t.Device, int, error) {
+	users.mu.RLock()
+	defer users.mu.RUnlock()
+
+	out := make(map[t.Uid][]t.Device, len(uids))
+	count := 0
+	for _, uid := range uids {
+		devs := users.devices[uid]
+		if len(devs) == 0 {
+			continue
+		}
+		out[uid] = devs
+		count += len(devs)
+	}
+	return out, count, nil
+}
+
+// Delete removes a single device token, e.g. after a push provider reports it as no longer
+// registered.
+func (DevicesObj) Delete(uid t.Uid, deviceID string) error {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+
+	devs := users.devices[uid]
+	for i, d := range devs {
+		if d.DeviceId == deviceID {
+			users.devices[uid] = append(devs[:i], devs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Package types holds the data structures shared between the store adapters and the rest of
+// the server, independent of any particular storage backend.
+package types
+
+// Uid is a unique user identifier.
+type Uid string
+
+// String implements fmt.Stringer.
+func (uid Uid) String() string {
+	return string(uid)
+}
+
+// AccessMode is a bitmask of permissions a user has in a topic.
+type AccessMode uint
+
+// Access mode bits.
+const (
+	ModeJoin AccessMode = 1 << iota
+	ModeRead
+	ModeWrite
+	ModePres
+	ModeApprove
+	ModeShare
+	ModeDelete
+	ModeOwner
+)
+
+// modeLetters maps each access mode bit to the letter used in its string representation, in
+// the canonical JRWPASDO order used by the wire protocol.
+var modeLetters = []struct {
+	bit    AccessMode
+	letter byte
+}{
+	{ModeJoin, 'J'},
+	{ModeRead, 'R'},
+	{ModeWrite, 'W'},
+	{ModePres, 'P'},
+	{ModeApprove, 'A'},
+	{ModeShare, 'S'},
+	{ModeDelete, 'D'},
+	{ModeOwner, 'O'},
+}
+
+// String renders the access mode as its canonical letter-flag representation, e.g. "JRWP".
+func (m AccessMode) String() string {
+	if m == 0 {
+		return "N"
+	}
+	buf := make([]byte, 0, len(modeLetters))
+	for _, ml := range modeLetters {
+		if m&ml.bit != 0 {
+			buf = append(buf, ml.letter)
+		}
+	}
+	return string(buf)
+}
+
+// Device is a single registered client device capable of receiving push notifications.
+type Device struct {
+	// DeviceId is the provider-specific push token: an FCM/APNs device token, an HMS push
+	// token, or a JSON-serialized Web Push subscription, depending on PushProvider.
+	DeviceId string
+	// Platform is the client platform: "android", "ios" or "web".
+	Platform string
+	// PushProvider routes the device to a specific push/ backend ("fcm", "apns", "hms",
+	// "webpush"). Empty means the default, "fcm".
+	PushProvider string
+}
+
+// QuietHours is a user's configured do-not-disturb window, expressed in minutes since
+// midnight and interpreted in Timezone. A zero-value window (From == To) means quiet hours
+// are disabled.
+type QuietHours struct {
+	From     int    `json:"from"`
+	To       int    `json:"to"`
+	Timezone string `json:"timezone"`
+}
+
+// PushPrefs are a single user's push notification preferences, consulted by every push/
+// provider before a notification is sent.
+type PushPrefs struct {
+	// QuietHours silences all but badge-only pushes while 'now' falls inside the window.
+	QuietHours QuietHours `json:"quiet_hours,omitempty"`
+	// MutedTopics lists topics the user does not want pushes from at all, keyed by topic name.
+	MutedTopics map[string]bool `json:"muted_topics,omitempty"`
+	// MinPriority drops pushes whose resolved priority ranks below this value ("low",
+	// "normal" or "high"). Empty means no filtering.
+	MinPriority string `json:"min_priority,omitempty"`
+}